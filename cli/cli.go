@@ -1,7 +1,10 @@
 package cli
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mvisonneau/ahs/cmd"
@@ -11,11 +14,14 @@ import (
 
 // Run handles the instanciation of the CLI application
 func Run(version string) {
-	NewApp(version, time.Now()).Run(os.Args)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	NewApp(version, time.Now(), ctx).Run(os.Args)
 }
 
 // NewApp configures the CLI application
-func NewApp(version string, start time.Time) (app *cli.App) {
+func NewApp(version string, start time.Time, ctx context.Context) (app *cli.App) {
 	app = cli.NewApp()
 	app.Name = "ahs"
 	app.Version = version
@@ -28,6 +34,22 @@ func NewApp(version string, start time.Time) (app *cli.App) {
 			EnvVar: "AHS_DRY_RUN",
 			Usage:  "only display what would have been done",
 		},
+		cli.StringFlag{
+			Name:   "imds-version",
+			EnvVar: "AHS_IMDS_VERSION",
+			Usage:  "when set to 'v2', enforces a token requirement on the instance's metadata options so only IMDSv2 requests are accepted; 'auto' leaves the SDK's default v2-with-v1-fallback negotiation in place (v2,auto)",
+			Value:  "auto",
+		},
+		cli.IntFlag{
+			Name:   "imds-hop-limit",
+			EnvVar: "AHS_IMDS_HOP_LIMIT",
+			Usage:  "if set, raise the instance's metadata service hop limit to this value (useful from within containers)",
+		},
+		cli.IntFlag{
+			Name:   "imds-token-ttl",
+			EnvVar: "AHS_IMDS_TOKEN_TTL",
+			Usage:  "removed: aws-sdk-go-v2's IMDS client does not expose a token TTL override, so setting this now fails fast instead of being silently ignored",
+		},
 		cli.StringFlag{
 			Name:   "input-tag",
 			EnvVar: "AHS_INPUT_TAG",
@@ -90,6 +112,11 @@ func NewApp(version string, start time.Time) (app *cli.App) {
 			Usage:     "compute a sequential hostname based on the number of instances belonging to the same group",
 			ArgsUsage: " ",
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "claim-mode",
+					EnvVar: "AHS_CLAIM_MODE",
+					Usage:  "`mode` used to avoid duplicate sequential ids when instances boot concurrently (\"\",optimistic)",
+				},
 				cli.StringFlag{
 					Name:   "instance-sequential-id-tag",
 					EnvVar: "AHS_INSTANCE_SEQUENTIAL_ID_TAG",
@@ -114,6 +141,7 @@ func NewApp(version string, start time.Time) (app *cli.App) {
 
 	app.Metadata = map[string]interface{}{
 		"startTime": start,
+		"ctx":       ctx,
 	}
 
 	return
@@ -0,0 +1,729 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"regexp"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/jpillora/backoff"
+	"github.com/mvisonneau/ahs/internal/cloud"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// Params of the app
+type Params struct {
+	InputTag     string
+	OutputTag    string
+	Separator    string
+	IMDSVersion  string
+	IMDSHopLimit int
+}
+
+// Clients of AWS libs
+type Clients struct {
+	EC2 cloud.EC2API
+	MDS cloud.MetadataAPI
+}
+
+// Values computed/generated
+type Values struct {
+	AZ           string
+	Base         string
+	Hostname     string
+	InstanceID   string
+	Region       string
+	SequentialID int
+}
+
+var start time.Time
+
+// Run is the cli.ActionFunc backing both the instance-id and sequential
+// commands.
+func Run(cliCtx *cli.Context) error {
+	start = time.Now()
+
+	logger := &Logger{
+		Level:  cliCtx.GlobalString("log-level"),
+		Format: cliCtx.GlobalString("log-format"),
+	}
+
+	if err := logger.Configure(); err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	if user, err := user.Current(); err != nil {
+		return exit(cli.NewExitError("Unable to determine current user", 1))
+	} else if user.Username != "root" {
+		return exit(cli.NewExitError("You have to run this function as root", 1))
+	}
+
+	ctx, ok := cliCtx.App.Metadata["ctx"].(context.Context)
+	if !ok {
+		ctx = context.Background()
+	}
+
+	if cliCtx.GlobalIsSet("imds-token-ttl") {
+		return exit(cli.NewExitError("imds-token-ttl is no longer supported: aws-sdk-go-v2's IMDS client does not expose a token TTL override", 1))
+	}
+
+	p := &Params{
+		InputTag:     cliCtx.GlobalString("input-tag"),
+		OutputTag:    cliCtx.GlobalString("output-tag"),
+		Separator:    cliCtx.GlobalString("separator"),
+		IMDSVersion:  cliCtx.GlobalString("imds-version"),
+		IMDSHopLimit: cliCtx.GlobalInt("imds-hop-limit"),
+	}
+
+	if err := validateIMDSVersion(p.IMDSVersion); err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	if cliCtx.Command.FullName() == "sequential" {
+		if err := validateClaimMode(cliCtx.String("claim-mode")); err != nil {
+			return exit(cli.NewExitError(err.Error(), 1))
+		}
+	}
+
+	c := &Clients{
+		EC2: nil,
+		MDS: nil,
+	}
+
+	v := &Values{
+		AZ:           "",
+		Base:         "",
+		Hostname:     "",
+		InstanceID:   "",
+		Region:       "",
+		SequentialID: -1,
+	}
+
+	// Configure MDS Client
+	if err := c.getAWSMDSClient(ctx); err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	// Fetch current AZ
+	var err error
+	v.AZ, err = c.getInstanceAZ(ctx)
+	if err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	// Compute region from AZ
+	v.Region, err = computeRegionFromAZ(v.AZ)
+	if err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	// Configure EC2 Client
+	if err := c.getAWSEC2Client(ctx, v.Region); err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	// Fetch instance ID
+	v.InstanceID, err = c.getInstanceID(ctx)
+	if err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	// Enforce IMDSv2 and/or raise the hop limit, useful when metadata is
+	// proxied through container network hops. This mutates the live
+	// instance, so it is skipped under dry-run just like every other
+	// mutation further down.
+	if p.IMDSVersion == "v2" || p.IMDSHopLimit > 0 {
+		if cliCtx.GlobalBool("dry-run") {
+			log.Infof("Configuring instance metadata options on instance '%s' (dry-run)", v.InstanceID)
+		} else if err := c.configureInstanceMetadataOptions(ctx, v.InstanceID, p.IMDSVersion, p.IMDSHopLimit); err != nil {
+			return exit(cli.NewExitError(analyzeEC2APIErrors(err), 1))
+		}
+	}
+
+	// Fetch the value of the input-tag and use it a base for the hostname.
+	// The EC2 client's configured retryer only covers a failed/throttled
+	// DescribeInstances call, not a successful one whose instance simply
+	// doesn't carry the tag yet, so waitForBaseFromInputTag retries that
+	// case itself to ride out tag-propagation lag on a freshly launched
+	// instance.
+	v.Base, err = c.waitForBaseFromInputTag(ctx, p.InputTag, v.InstanceID)
+	if err != nil {
+		return exit(cli.NewExitError(analyzeEC2APIErrors(err), 1))
+	}
+
+	switch cliCtx.Command.FullName() {
+	case "instance-id":
+		v.Hostname, err = computeHostnameWithInstanceID(v.Base, v.InstanceID, p.Separator, cliCtx.Int("length"))
+	case "sequential":
+		v.Hostname, v.SequentialID, err = c.computeSequentialHostname(ctx, v.Base, v.InstanceID, v.AZ, p.Separator, cliCtx.String("instance-group-tag"), cliCtx.String("instance-sequential-id-tag"), cliCtx.String("claim-mode"), cliCtx.Bool("respect-azs"), cliCtx.GlobalBool("dry-run"))
+	default:
+		return exit(cli.NewExitError(fmt.Sprintf("Function %v is not implemented", cliCtx.Command.FullName()), 1))
+	}
+
+	if err != nil {
+		return exit(cli.NewExitError(err.Error(), 1))
+	}
+
+	if !cliCtx.GlobalBool("dry-run") {
+		previousHostname, hostErr := getSystemHostname()
+		if hostErr != nil {
+			log.Warnf("Unable to determine current hostname, rollback on persist or tag failure will be unavailable: %s", hostErr)
+		}
+
+		log.Infof("Setting instance hostname locally")
+		if err := setSystemHostname(v.Hostname); err != nil {
+			return exit(cli.NewExitError(err.Error(), 1))
+		}
+
+		// hostnamePersisted/hostsPersisted track which persisted state
+		// rollbackHostname has to undo if a later step in this sequence
+		// fails: reverting the in-memory hostname alone would leave
+		// /etc/hostname or /etc/hosts holding the new value.
+		var hostnamePersisted, hostsPersisted bool
+
+		if cliCtx.GlobalBool("persist-hostname") {
+			log.Infof("Persisting hostname to /etc/hostname")
+			if err := persistHostname(v.Hostname); err != nil {
+				rollbackHostname(v.Hostname, previousHostname, hostnamePersisted, hostsPersisted)
+				return exit(cli.NewExitError(err.Error(), 1))
+			}
+			hostnamePersisted = true
+		}
+
+		if cliCtx.GlobalBool("persist-hosts") {
+			log.Infof("Persisting hostname entry to /etc/hosts")
+			if err := persistHosts(v.Hostname); err != nil {
+				rollbackHostname(v.Hostname, previousHostname, hostnamePersisted, hostsPersisted)
+				return exit(cli.NewExitError(err.Error(), 1))
+			}
+			hostsPersisted = true
+		}
+
+		log.Infof("Setting hostname on configured instance output tag '%s'", p.OutputTag)
+		if err := c.setTagValue(ctx, v.InstanceID, p.OutputTag, v.Hostname); err != nil {
+			rollbackHostname(v.Hostname, previousHostname, hostnamePersisted, hostsPersisted)
+			return exit(cli.NewExitError(analyzeEC2APIErrors(err), 1))
+		}
+
+		if cliCtx.Command.FullName() == "sequential" {
+			log.Infof("Setting instance sequential id (%d) on configured tag '%s'", v.SequentialID, cliCtx.String("instance-sequential-id-tag"))
+			if err := c.setTagValue(ctx, v.InstanceID, cliCtx.String("instance-sequential-id-tag"), strconv.Itoa(v.SequentialID)); err != nil {
+				rollbackHostname(v.Hostname, previousHostname, hostnamePersisted, hostsPersisted)
+				return exit(cli.NewExitError(analyzeEC2APIErrors(err), 1))
+			}
+		}
+	} else {
+		log.Infof("Setting instance hostname locally (dry-run)")
+		log.Infof("Setting hostname on configured instance tag '%s' (dry-run)", p.OutputTag)
+		if cliCtx.GlobalBool("persist-hostname") {
+			log.Infof("Persisting hostname '%s' to /etc/hostname (dry-run)", v.Hostname)
+		}
+		if cliCtx.GlobalBool("persist-hosts") {
+			log.Infof("Persisting entry '127.0.0.1 %s' to /etc/hosts (dry-run)", v.Hostname)
+		}
+		if cliCtx.Command.FullName() == "sequential" {
+			log.Infof("Setting instance sequential id (%d) on configured tag '%s' (dry-run)", v.SequentialID, cliCtx.String("instance-sequential-id-tag"))
+		}
+	}
+
+	return exit(nil)
+}
+
+func (c *Clients) getAWSMDSClient(ctx context.Context) error {
+	log.Debug("Starting AWS MDS API session")
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The client always negotiates a v2 (token-based) session first and
+	// transparently falls back to unauthenticated v1 requests, so there is
+	// nothing version-specific to configure here; see
+	// configureInstanceMetadataOptions for enforcing v2-only at the instance
+	// level.
+	c.MDS = imds.NewFromConfig(cfg)
+
+	return nil
+}
+
+// configureInstanceMetadataOptions requires a signed IMDSv2 token on every
+// metadata request and/or raises the HTTP PUT response hop limit, depending
+// on which of version/hopLimit the caller has set.
+func (c *Clients) configureInstanceMetadataOptions(ctx context.Context, instanceID string, version string, hopLimit int) error {
+	input := &ec2.ModifyInstanceMetadataOptionsInput{
+		InstanceId: aws.String(instanceID),
+	}
+
+	if version == "v2" {
+		log.Infof("Enforcing IMDSv2 token requirement on instance '%s'", instanceID)
+		input.HttpTokens = types.HttpTokensStateRequired
+	}
+
+	if hopLimit > 0 {
+		log.Infof("Setting IMDS hop limit to '%d' on instance '%s'", hopLimit, instanceID)
+		input.HttpPutResponseHopLimit = aws.Int32(int32(hopLimit))
+	}
+
+	_, err := c.EC2.ModifyInstanceMetadataOptions(ctx, input)
+
+	return err
+}
+
+func (c *Clients) getAWSEC2Client(ctx context.Context, region string) error {
+	re := regexp.MustCompile("[a-z]{2}-[a-z]+-\\d")
+	if !re.MatchString(region) {
+		return fmt.Errorf("Cannot start AWS EC2 client session with invalid region '%s'", region)
+	}
+
+	log.Debug("Starting AWS EC2 Client session")
+	cfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(region),
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = 5
+				o.MaxBackoff = 30 * time.Second
+			})
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	c.EC2 = ec2.NewFromConfig(cfg)
+	return nil
+}
+
+// validateIMDSVersion rejects any imds-version value other than the ones
+// configureInstanceMetadataOptions actually implements: aws-sdk-go-v2's IMDS
+// client no longer exposes a way to force plain-v1 transport, so 'v1' can't
+// be told apart from 'auto' anymore and is rejected rather than silently
+// aliased to it.
+func validateIMDSVersion(version string) error {
+	switch version {
+	case "auto", "v2":
+		return nil
+	default:
+		return fmt.Errorf("Unsupported imds-version '%s': only 'auto' and 'v2' are implemented, 'v1' can no longer be forced separately from 'auto'", version)
+	}
+}
+
+// validateClaimMode rejects any claim-mode value other than the ones
+// computeSequentialHostname understands, so a typo doesn't silently fall
+// back to the racy default allocation path.
+func validateClaimMode(mode string) error {
+	switch mode {
+	case "", "optimistic":
+		return nil
+	default:
+		return fmt.Errorf("Unsupported claim-mode '%s', expected '' or 'optimistic'", mode)
+	}
+}
+
+func (c *Clients) getInstanceAZ(ctx context.Context) (az string, err error) {
+	log.Debug("Fetching current AZ from MDS API")
+	az, err = c.getMetadata(ctx, "placement/availability-zone")
+	log.Infof("Found AZ: '%s'", az)
+	return
+}
+
+func computeRegionFromAZ(az string) (region string, err error) {
+	re := regexp.MustCompile("[a-z]{2}-[a-z]+-\\d[a-z]")
+	if !re.MatchString(az) {
+		err = fmt.Errorf("Cannot compute region from invalid availability-zone '%s'", az)
+		return
+	}
+
+	region = az[:len(az)-1]
+	log.Infof("Computed region : '%s'", region)
+	return
+}
+
+func (c *Clients) getInstanceID(ctx context.Context) (iid string, err error) {
+	log.Debug("Fetching current instance-id from MDS API")
+	iid, err = c.getMetadata(ctx, "instance-id")
+	log.Infof("Found instance-id : '%s'", iid)
+	return
+}
+
+func (c *Clients) getMetadata(ctx context.Context, path string) (string, error) {
+	out, err := c.MDS.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+	if err != nil {
+		return "", errors.New("Unable to access the metadata service, are you running this binary from an AWS EC2 instance?")
+	}
+	defer out.Content.Close()
+
+	value, err := io.ReadAll(out.Content)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
+
+// inputTagPropagationTimeout bounds how long waitForBaseFromInputTag retries
+// a missing input-tag before giving up: EC2 tag propagation on a freshly
+// launched instance, the primary scenario ahs runs in, can lag instance
+// launch by up to roughly two minutes.
+const inputTagPropagationTimeout = 120 * time.Second
+
+// inputTagNotFoundError reports a successful DescribeInstances response
+// whose instance simply doesn't carry inputTag yet. It is kept distinct
+// from a failed/throttled API call so that waitForBaseFromInputTag knows
+// which errors from getBaseFromInputTag are worth retrying.
+type inputTagNotFoundError struct {
+	inputTag string
+}
+
+func (e *inputTagNotFoundError) Error() string {
+	return fmt.Sprintf("Instance doesn't contain input-tag '%s'", e.inputTag)
+}
+
+// waitForBaseFromInputTag retries getBaseFromInputTag while it keeps
+// reporting a missing input-tag, up to inputTagPropagationTimeout, so a
+// freshly launched instance has time to catch up on tag propagation. Any
+// other error is returned immediately.
+func (c *Clients) waitForBaseFromInputTag(ctx context.Context, inputTag, instanceID string) (string, error) {
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    5 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	deadline := time.Now().Add(inputTagPropagationTimeout)
+
+	for {
+		base, err := c.getBaseFromInputTag(ctx, inputTag, instanceID)
+		if err == nil {
+			return base, nil
+		}
+
+		var notFound *inputTagNotFoundError
+		if !errors.As(err, &notFound) || time.Now().After(deadline) {
+			return "", err
+		}
+
+		d := b.Duration()
+		log.Infof("%s, retrying in %s", err, d)
+
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (c *Clients) getBaseFromInputTag(ctx context.Context, inputTag, instanceID string) (string, error) {
+	log.Infof("Querying input-tag '%s' from EC2 API", inputTag)
+	instances, err := c.EC2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name: aws.String("instance-id"),
+				Values: []string{
+					instanceID,
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, reservation := range instances.Reservations {
+		for _, instance := range reservation.Instances {
+			for _, tag := range instance.Tags {
+				if *tag.Key == inputTag {
+					log.Debugf("Found input-tag '%s' : '%s' ", inputTag, *tag.Value)
+					return *tag.Value, nil
+				}
+			}
+		}
+	}
+
+	return "", &inputTagNotFoundError{inputTag: inputTag}
+}
+
+func analyzeEC2APIErrors(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorMessage()
+	}
+
+	return err.Error()
+}
+
+func setSystemHostname(hostname string) error {
+	return syscall.Sethostname([]byte(hostname))
+}
+
+func getSystemHostname() (string, error) {
+	return os.Hostname()
+}
+
+func (c *Clients) setTagValue(ctx context.Context, instanceID, tag, value string) (err error) {
+	_, err = c.EC2.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: []string{
+			instanceID,
+		},
+		Tags: []types.Tag{
+			{
+				Key:   aws.String(tag),
+				Value: aws.String(value),
+			},
+		},
+	})
+
+	return
+}
+
+func computeHostnameWithInstanceID(base, instanceID, separator string, length int) (string, error) {
+	log.Info("Computing hostname with truncated instance-id")
+
+	if base[len(base)-length:] == instanceID[2:2+length] {
+		log.Infof("Instance ID already found in the instance tag : '%s', reusing this value", base)
+		return base, nil
+	}
+
+	hostname := base + separator + instanceID[2:2+length]
+	log.Infof("Computed unique hostname : '%s'", hostname)
+
+	return hostname, nil
+}
+
+func (c *Clients) computeSequentialHostname(ctx context.Context, base, instanceID, az, separator, groupTag, sequentialIDTag, claimMode string, respectAZs, dryRun bool) (string, int, error) {
+	log.Info("Computing a hostname with sequential naming")
+
+	re := regexp.MustCompile(".*-(\\d+)$")
+	if re.MatchString(base) {
+		sequentialID, err := strconv.Atoi(re.FindStringSubmatch(base)[1])
+		log.Infof("Current input tag value already matches '.*-\\d+$', keeping '%s' as hostname, '%d' as sequentialID", base, sequentialID)
+
+		return base, sequentialID, err
+	}
+
+	instanceGroup, err := c.findInstanceGroupTagValue(ctx, groupTag, instanceID)
+	if err != nil {
+		return "", -1, err
+	}
+
+	var sequentialID int
+	if claimMode == "optimistic" {
+		sequentialID, err = c.claimSequentialID(ctx, instanceID, instanceGroup, groupTag, sequentialIDTag, az, respectAZs, dryRun)
+	} else {
+		sequentialID, err = c.findAvailableNumberInInstanceGroup(ctx, instanceGroup, groupTag, sequentialIDTag, az, respectAZs)
+	}
+	if err != nil {
+		return "", -1, err
+	}
+
+	hostname := base + separator + strconv.Itoa(sequentialID)
+	log.Infof("Computed unique hostname : '%s' - Sequential ID : '%d'", hostname, sequentialID)
+
+	return hostname, sequentialID, nil
+}
+
+func (c *Clients) findInstanceGroupTagValue(ctx context.Context, groupTag, instanceID string) (string, error) {
+	log.Debugf("Looking up the value of the tag '%s' of the instance", groupTag)
+	tags, err := c.EC2.DescribeTags(ctx, &ec2.DescribeTagsInput{
+		Filters: []types.Filter{
+			{
+				Name: aws.String("resource-type"),
+				Values: []string{
+					"instance",
+				},
+			},
+			{
+				Name: aws.String("resource-id"),
+				Values: []string{
+					instanceID,
+				},
+			},
+			{
+				Name: aws.String("key"),
+				Values: []string{
+					groupTag,
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(tags.Tags) != 1 {
+		return "", fmt.Errorf("Unexpected amount of tags retrieved : '%d',  expected 1", len(tags.Tags))
+	}
+
+	log.Debugf("Found instance-group value : '%s'", *tags.Tags[0].Value)
+	return *tags.Tags[0].Value, nil
+}
+
+func (c *Clients) findAvailableNumberInInstanceGroup(ctx context.Context, instanceGroup, groupTag, sequentialIDTag, az string, respectAZs bool) (int, error) {
+	used, err := c.usedSequentialIDsInInstanceGroup(ctx, instanceGroup, groupTag, sequentialIDTag, az, respectAZs)
+	if err != nil {
+		return -1, err
+	}
+
+	return smallestAvailableID(used), nil
+}
+
+// usedSequentialIDsInInstanceGroup returns the sorted, de-duplicated list of
+// sequentialIDTag values currently held by non-terminated instances of
+// instanceGroup.
+func (c *Clients) usedSequentialIDsInInstanceGroup(ctx context.Context, instanceGroup, groupTag, sequentialIDTag, az string, respectAZs bool) ([]int, error) {
+	log.Debugf("Looking up sequential ids already in use in the group")
+
+	filters := []types.Filter{
+		{
+			Name: aws.String("resource-type"),
+			Values: []string{
+				"instance",
+			},
+		},
+		{
+			Name: aws.String("key"),
+			Values: []string{
+				sequentialIDTag,
+			},
+		},
+		{
+			Name: aws.String("tag:" + groupTag),
+			Values: []string{
+				instanceGroup,
+			},
+		},
+	}
+
+	holders := map[string]int{}
+
+	paginator := ec2.NewDescribeTagsPaginator(c.EC2, &ec2.DescribeTagsInput{
+		Filters: filters,
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range page.Tags {
+			v, err := strconv.Atoi(*tag.Value)
+			if err != nil {
+				return nil, err
+			}
+
+			holders[*tag.ResourceId] = v
+			log.Debugf("Found instance '%s' holding sequential id '%d'", *tag.ResourceId, v)
+		}
+	}
+
+	used, err := c.filterTerminatedHolders(ctx, holders, az, respectAZs)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(used)
+
+	deduped := used[:0]
+	for i, id := range used {
+		if i == 0 || id != used[i-1] {
+			deduped = append(deduped, id)
+		}
+	}
+
+	return deduped, nil
+}
+
+// smallestAvailableID returns the smallest positive integer missing from
+// the sorted, de-duplicated slice used.
+func smallestAvailableID(used []int) int {
+	for i := 0; i < len(used); i++ {
+		if used[i] != i+1 {
+			return i + 1
+		}
+	}
+
+	return len(used) + 1
+}
+
+// filterTerminatedHolders takes a map of instance-id to the sequential id it
+// holds and returns only the values still held by a non-terminated instance
+// in the given AZ (when respectAZs is set), so that ids belonging to
+// terminated/shutting-down or out-of-AZ instances are recycled instead of
+// permanently reserved. It batches a single DescribeInstances call across
+// all the given instance ids; unlike DescribeTags, DescribeInstances
+// supports the placement-availability-zone filter, which is where AZ
+// scoping has to happen.
+func (c *Clients) filterTerminatedHolders(ctx context.Context, holders map[string]int, az string, respectAZs bool) ([]int, error) {
+	if len(holders) == 0 {
+		return nil, nil
+	}
+
+	instanceIDs := make([]string, 0, len(holders))
+	for id := range holders {
+		instanceIDs = append(instanceIDs, id)
+	}
+
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIDs,
+	}
+
+	if respectAZs {
+		log.Debugf("Scoping the numbering space to AZ '%s'", az)
+		input.Filters = []types.Filter{
+			{
+				Name: aws.String("placement-availability-zone"),
+				Values: []string{
+					az,
+				},
+			},
+		}
+	}
+
+	instances, err := c.EC2.DescribeInstances(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	var used []int
+	for _, reservation := range instances.Reservations {
+		for _, instance := range reservation.Instances {
+			switch instance.State.Name {
+			case types.InstanceStateNameTerminated, types.InstanceStateNameShuttingDown:
+				log.Debugf("Recycling sequential id '%d' held by %s instance '%s'", holders[*instance.InstanceId], instance.State.Name, *instance.InstanceId)
+			default:
+				used = append(used, holders[*instance.InstanceId])
+			}
+		}
+	}
+
+	return used, nil
+}
+
+func exit(err error) error {
+	log.Debugf("Executed in %s, exiting..", time.Since(start))
+	return err
+}
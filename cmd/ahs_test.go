@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/mvisonneau/ahs/internal/cloud"
+)
+
+func TestFindAvailableNumberInInstanceGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		used     []string
+		expected int
+	}{
+		{"empty group", nil, 1},
+		{"fills the first gap", []string{"1", "2", "4"}, 3},
+		{"appends when there is no gap", []string{"1", "2", "3"}, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := cloud.NewFakeEC2()
+			for i, v := range tt.used {
+				fake.AddInstance(&cloud.FakeInstance{
+					ID:    fmt.Sprintf("i-%d", i),
+					State: "running",
+					Tags: map[string]string{
+						"ahs:instance-group": "web",
+						"ahs:instance-id":    v,
+					},
+				})
+			}
+
+			c := &Clients{EC2: fake}
+			got, err := c.findAvailableNumberInInstanceGroup(context.Background(), "web", "ahs:instance-group", "ahs:instance-id", "", false)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.expected {
+				t.Fatalf("expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestFindAvailableNumberInInstanceGroupRace demonstrates the TOCTOU window
+// exploited by two instances booting at the same time in the non-claim
+// default path: both read the same "lowest free" candidate, then both write
+// it back as their own sequentialIDTag, producing a genuine duplicate. A
+// barrier holds both goroutines at the read until both have observed the
+// same candidate, so the collision reproduces deterministically instead of
+// depending on goroutine scheduling; this is exactly the window
+// --claim-mode=optimistic (see claimSequentialID) exists to close.
+func TestFindAvailableNumberInInstanceGroupRace(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-1111", State: "running", Tags: map[string]string{"ahs:instance-group": "web"}})
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-9999", State: "running", Tags: map[string]string{"ahs:instance-group": "web"}})
+
+	c := &Clients{EC2: fake}
+
+	var atBarrier sync.WaitGroup
+	atBarrier.Add(2)
+	release := make(chan struct{})
+
+	results := make(map[string]int, 2)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, instanceID := range []string{"i-1111", "i-9999"} {
+		wg.Add(1)
+		go func(instanceID string) {
+			defer wg.Done()
+
+			candidate, err := c.findAvailableNumberInInstanceGroup(context.Background(), "web", "ahs:instance-group", "ahs:instance-id", "", false)
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+
+			atBarrier.Done()
+			<-release
+
+			if err := c.setTagValue(context.Background(), instanceID, "ahs:instance-id", fmt.Sprint(candidate)); err != nil {
+				t.Errorf("unexpected error tagging '%s': %s", instanceID, err)
+				return
+			}
+
+			mu.Lock()
+			results[instanceID] = candidate
+			mu.Unlock()
+		}(instanceID)
+	}
+
+	atBarrier.Wait()
+	close(release)
+	wg.Wait()
+
+	if results["i-1111"] != results["i-9999"] {
+		t.Fatalf("expected both instances to race to the same candidate id, got %v", results)
+	}
+	if fake.Instances["i-1111"].Tags["ahs:instance-id"] != fake.Instances["i-9999"].Tags["ahs:instance-id"] {
+		t.Fatalf("expected the TOCTOU window to leave both instances tagged with the same sequential id, got i-1111=%s i-9999=%s",
+			fake.Instances["i-1111"].Tags["ahs:instance-id"], fake.Instances["i-9999"].Tags["ahs:instance-id"])
+	}
+}
+
+// TestFindAvailableNumberInInstanceGroupRecyclesTerminated ensures ids held
+// by instances that have since terminated are treated as free rather than
+// permanently reserved.
+func TestFindAvailableNumberInInstanceGroupRecyclesTerminated(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{
+		ID:    "i-1",
+		State: "terminated",
+		Tags: map[string]string{
+			"ahs:instance-group": "web",
+			"ahs:instance-id":    "1",
+		},
+	})
+	fake.AddInstance(&cloud.FakeInstance{
+		ID:    "i-2",
+		State: "running",
+		Tags: map[string]string{
+			"ahs:instance-group": "web",
+			"ahs:instance-id":    "2",
+		},
+	})
+
+	c := &Clients{EC2: fake}
+	got, err := c.findAvailableNumberInInstanceGroup(context.Background(), "web", "ahs:instance-group", "ahs:instance-id", "", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != 1 {
+		t.Fatalf("expected id '1' held by a terminated instance to be recycled, got %d", got)
+	}
+}
+
+func TestFindAvailableNumberInInstanceGroupRespectsAZs(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{
+		ID:    "i-a",
+		State: "running",
+		AZ:    "eu-west-1a",
+		Tags: map[string]string{
+			"ahs:instance-group": "web",
+			"ahs:instance-id":    "1",
+		},
+	})
+	fake.AddInstance(&cloud.FakeInstance{
+		ID:    "i-b",
+		State: "running",
+		AZ:    "eu-west-1b",
+		Tags: map[string]string{
+			"ahs:instance-group": "web",
+			"ahs:instance-id":    "1",
+		},
+	})
+
+	c := &Clients{EC2: fake}
+
+	got, err := c.findAvailableNumberInInstanceGroup(context.Background(), "web", "ahs:instance-group", "ahs:instance-id", "eu-west-1b", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != 2 {
+		t.Fatalf("expected the AZ-scoped numbering space to ignore instance 'i-a' and return 2, got %d", got)
+	}
+}
+
+func TestGetBaseFromInputTag(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-1", State: "running"})
+
+	c := &Clients{EC2: fake}
+
+	if _, err := c.getBaseFromInputTag(context.Background(), "Name", "i-1"); err == nil {
+		t.Fatal("expected an error before the input-tag has been set on the instance")
+	}
+
+	if _, err := fake.CreateTags(context.Background(), &ec2.CreateTagsInput{
+		Resources: []string{"i-1"},
+		Tags: []types.Tag{
+			{Key: aws.String("Name"), Value: aws.String("web")},
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error tagging instance: %s", err)
+	}
+
+	base, err := c.getBaseFromInputTag(context.Background(), "Name", "i-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if base != "web" {
+		t.Fatalf("expected 'web', got '%s'", base)
+	}
+}
+
+// TestWaitForBaseFromInputTagRetriesUntilTagPropagates guards against
+// getBaseFromInputTag's "tag not found" error being treated as terminal: a
+// freshly launched instance routinely doesn't have the input-tag visible
+// yet, and waitForBaseFromInputTag must keep polling until it appears
+// instead of failing on the first DescribeInstances call.
+func TestWaitForBaseFromInputTagRetriesUntilTagPropagates(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-1", State: "running"})
+
+	c := &Clients{EC2: fake}
+
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		if err := c.setTagValue(context.Background(), "i-1", "Name", "web"); err != nil {
+			t.Errorf("unexpected error tagging instance: %s", err)
+		}
+	}()
+
+	base, err := c.waitForBaseFromInputTag(context.Background(), "Name", "i-1")
+	if err != nil {
+		t.Fatalf("expected waitForBaseFromInputTag to retry through the propagation lag, got: %s", err)
+	}
+	if base != "web" {
+		t.Fatalf("expected 'web', got '%s'", base)
+	}
+}
+
+// describeInstancesErrorEC2 wraps a FakeEC2 to force DescribeInstances to
+// fail, so tests can exercise error paths the fake otherwise can't reach.
+type describeInstancesErrorEC2 struct {
+	*cloud.FakeEC2
+	err error
+}
+
+func (e *describeInstancesErrorEC2) DescribeInstances(context.Context, *ec2.DescribeInstancesInput, ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	return nil, e.err
+}
+
+// TestWaitForBaseFromInputTagReturnsOtherErrorsImmediately guards against a
+// non-"tag not found" error (e.g. a DescribeInstances failure) being
+// retried, since only tag-propagation lag is worth waiting out.
+func TestWaitForBaseFromInputTagReturnsOtherErrorsImmediately(t *testing.T) {
+	wantErr := fmt.Errorf("boom")
+	c := &Clients{EC2: &describeInstancesErrorEC2{FakeEC2: cloud.NewFakeEC2(), err: wantErr}}
+
+	_, err := c.waitForBaseFromInputTag(context.Background(), "Name", "i-1")
+	if err != wantErr {
+		t.Fatalf("expected the DescribeInstances error to be returned immediately, got: %s", err)
+	}
+}
+
+func TestValidateIMDSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		wantErr bool
+	}{
+		{"auto", false},
+		{"v2", false},
+		{"v1", true},
+		{"bogus", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			err := validateIMDSVersion(tt.version)
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected an error for imds-version '%s'", tt.version)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error for imds-version '%s': %s", tt.version, err)
+			}
+		})
+	}
+}
+
+func TestValidateClaimMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{"", false},
+		{"optimistic", false},
+		{"optimisitc", true},
+		{"bogus", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			err := validateClaimMode(tt.mode)
+			if tt.wantErr && err == nil {
+				t.Fatalf("expected an error for claim-mode '%s'", tt.mode)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error for claim-mode '%s': %s", tt.mode, err)
+			}
+		})
+	}
+}
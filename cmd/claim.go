@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/jpillora/backoff"
+	log "github.com/sirupsen/logrus"
+)
+
+const claimTagPrefix = "ahs:claim-"
+
+// claimSettleWindow is how long claimSequentialID waits between two reads
+// of a claim tag's claimants before trusting the result: a single
+// immediate read can observe itself as the sole claimant just because a
+// concurrent racer's own CreateTags call hasn't landed yet.
+const claimSettleWindow = 50 * time.Millisecond
+
+// claimSequentialID reserves a sequential id within instanceGroup using EC2
+// tags as a lightweight optimistic lock. It writes a candidate claim tag,
+// re-reads the group to see whether another instance wrote a claim for the
+// same number, and breaks ties deterministically (lowest instance-id
+// wins) so that both sides of a race converge onto distinct ids without an
+// external locking service.
+//
+// When dryRun is set, no claim tag is ever written: the first available
+// candidate is reported as-is, without contending for it, since a dry-run
+// caller must never mutate live instance state.
+func (c *Clients) claimSequentialID(ctx context.Context, instanceID, instanceGroup, groupTag, sequentialIDTag, az string, respectAZs, dryRun bool) (int, error) {
+	candidate, err := c.findAvailableNumberInInstanceGroup(ctx, instanceGroup, groupTag, sequentialIDTag, az, respectAZs)
+	if err != nil {
+		return -1, err
+	}
+
+	if dryRun {
+		log.Infof("Would claim sequential id '%d' (dry-run)", candidate)
+		return candidate, nil
+	}
+
+	b := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    5 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	// tried accumulates every candidate this call has lost a tiebreak on,
+	// so a retry never re-offers one of them even if the loser it beat us
+	// to hasn't promoted its claim to sequentialIDTag yet.
+	tried := map[int]bool{}
+
+	for {
+		tried[candidate] = true
+		claimTag := fmt.Sprintf("%s%d", claimTagPrefix, candidate)
+
+		log.Debugf("Claiming candidate sequential id '%d' with tag '%s'", candidate, claimTag)
+		if err := c.setTagValue(ctx, instanceID, claimTag, instanceID); err != nil {
+			return -1, err
+		}
+
+		winner, err := c.resolveStableClaim(ctx, b, instanceGroup, groupTag, claimTag, az, respectAZs)
+		if err != nil {
+			return -1, err
+		}
+
+		won := winner == instanceID
+		if won {
+			// A lone claimant on claimTag isn't proof the candidate is
+			// still free: the original winner may have already promoted
+			// it to sequentialIDTag and deleted its own claim tag before
+			// this straggling retry got here. Re-check against the
+			// confirmed set before trusting the trivial win.
+			used, err := c.usedSequentialIDsInInstanceGroup(ctx, instanceGroup, groupTag, sequentialIDTag, az, respectAZs)
+			if err != nil {
+				return -1, err
+			}
+			won = !containsInt(used, candidate)
+		}
+
+		if won {
+			log.Debugf("Won claim on sequential id '%d'", candidate)
+
+			if err := c.setTagValue(ctx, instanceID, sequentialIDTag, strconv.Itoa(candidate)); err != nil {
+				return -1, err
+			}
+
+			if err := c.deleteTagValue(ctx, instanceID, claimTag); err != nil {
+				return -1, err
+			}
+
+			return candidate, nil
+		}
+
+		log.Debugf("Lost claim on sequential id '%d', retrying with next candidate", candidate)
+		if err := c.deleteTagValue(ctx, instanceID, claimTag); err != nil {
+			return -1, err
+		}
+
+		select {
+		case <-time.After(b.Duration()):
+		case <-ctx.Done():
+			return -1, ctx.Err()
+		}
+
+		// Re-derive the candidate from the current tag state merged with
+		// every id tried so far: a plain candidate++ would only ever dodge
+		// the instance we just lost a tiebreak against, not an id that a
+		// third, non-racing instance already holds via a settled
+		// sequentialIDTag (no claim tag involved at all), and re-running
+		// findAvailableNumberInInstanceGroup alone can hand back the very
+		// candidate we just lost if the winner hasn't promoted its claim
+		// yet.
+		used, err := c.usedSequentialIDsInInstanceGroup(ctx, instanceGroup, groupTag, sequentialIDTag, az, respectAZs)
+		if err != nil {
+			return -1, err
+		}
+		for _, id := range used {
+			tried[id] = true
+		}
+		candidate = smallestIDNotIn(tried)
+	}
+}
+
+// smallestIDNotIn returns the smallest positive integer not present in
+// excluded.
+func smallestIDNotIn(excluded map[int]bool) int {
+	for i := 1; ; i++ {
+		if !excluded[i] {
+			return i
+		}
+	}
+}
+
+func containsInt(ints []int, target int) bool {
+	for _, i := range ints {
+		if i == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveStableClaim calls resolveClaim twice, separated by
+// claimSettleWindow, and only trusts the winner once both reads agree. This
+// is the "stable read" the claim is promoted on: without it, a claimant
+// could see itself as the sole holder of a claim tag simply because a
+// concurrent racer's CreateTags call for the same claim tag hadn't landed
+// yet at the time of the first read.
+func (c *Clients) resolveStableClaim(ctx context.Context, b *backoff.Backoff, instanceGroup, groupTag, claimTag, az string, respectAZs bool) (string, error) {
+	for {
+		first, err := c.resolveClaim(ctx, b, instanceGroup, groupTag, claimTag, az, respectAZs)
+		if err != nil {
+			return "", err
+		}
+
+		select {
+		case <-time.After(claimSettleWindow):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+
+		second, err := c.resolveClaim(ctx, b, instanceGroup, groupTag, claimTag, az, respectAZs)
+		if err != nil {
+			return "", err
+		}
+
+		if first == second {
+			return first, nil
+		}
+	}
+}
+
+// resolveClaim re-reads every instance in the group that has written the
+// given claim tag and deterministically picks a winner: the
+// lexicographically smallest instance-id. CreateTags is not
+// read-your-own-writes consistent against DescribeInstances, so seeing zero
+// claimants right after writing our own claim tag is a transient visibility
+// lag rather than a real failure; retry with b's backoff instead of erroring
+// out the whole run.
+func (c *Clients) resolveClaim(ctx context.Context, b *backoff.Backoff, instanceGroup, groupTag, claimTag, az string, respectAZs bool) (string, error) {
+	filters := []types.Filter{
+		{
+			Name:   aws.String("tag:" + groupTag),
+			Values: []string{instanceGroup},
+		},
+		{
+			Name:   aws.String("tag-key"),
+			Values: []string{claimTag},
+		},
+	}
+
+	if respectAZs {
+		filters = append(filters, types.Filter{
+			Name:   aws.String("placement-availability-zone"),
+			Values: []string{az},
+		})
+	}
+
+	for {
+		instances, err := c.EC2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+			Filters: filters,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		var claimants []string
+		for _, reservation := range instances.Reservations {
+			for _, instance := range reservation.Instances {
+				for _, tag := range instance.Tags {
+					if *tag.Key == claimTag {
+						claimants = append(claimants, *tag.Value)
+					}
+				}
+			}
+		}
+
+		if len(claimants) > 0 {
+			sort.Strings(claimants)
+			return claimants[0], nil
+		}
+
+		log.Debugf("No instance visible yet holding claim tag '%s', retrying", claimTag)
+		select {
+		case <-time.After(b.Duration()):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (c *Clients) deleteTagValue(ctx context.Context, instanceID, tag string) error {
+	_, err := c.EC2.DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{instanceID},
+		Tags: []types.Tag{
+			{Key: aws.String(tag)},
+		},
+	})
+
+	return err
+}
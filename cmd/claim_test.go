@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mvisonneau/ahs/internal/cloud"
+)
+
+func TestClaimSequentialIDResolvesConcurrentClaims(t *testing.T) {
+	ctx := context.Background()
+
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{
+		ID:    "i-1111",
+		State: "running",
+		Tags:  map[string]string{"ahs:instance-group": "web"},
+	})
+	fake.AddInstance(&cloud.FakeInstance{
+		ID:    "i-9999",
+		State: "running",
+		Tags:  map[string]string{"ahs:instance-group": "web"},
+	})
+
+	c := &Clients{EC2: fake}
+
+	// Simulate instance "i-1111" already having claimed candidate 1 before
+	// "i-9999" runs its own claim: "i-9999" must lose the tiebreak on
+	// candidate 1 (lexicographically larger) and move on to 2.
+	if err := c.setTagValue(ctx, "i-1111", claimTagPrefix+"1", "i-1111"); err != nil {
+		t.Fatalf("unexpected error seeding claim: %s", err)
+	}
+
+	got, err := c.claimSequentialID(ctx, "i-9999", "web", "ahs:instance-group", "ahs:instance-id", "", false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != 2 {
+		t.Fatalf("expected 'i-9999' to claim id 2, got %d", got)
+	}
+
+	if v := fake.Instances["i-9999"].Tags["ahs:instance-id"]; v != "2" {
+		t.Fatalf("expected sequentialIDTag to be promoted to '2', got '%s'", v)
+	}
+	if _, ok := fake.Instances["i-9999"].Tags[claimTagPrefix+"2"]; ok {
+		t.Fatal("expected the claim tag to be cleaned up after promotion")
+	}
+}
+
+// TestClaimSequentialIDSkipsSettledHolderAfterLosingTiebreak races two
+// instances ("i-1111", "i-9999") for the same candidate while a third,
+// non-racing instance ("i-aaaa") already holds a settled sequentialIDTag
+// with no claim tag involved at all. A blind candidate++ after losing the
+// tiebreak would never notice "i-aaaa"'s id and duplicate it.
+func TestClaimSequentialIDSkipsSettledHolderAfterLosingTiebreak(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{
+		ID:    "i-aaaa",
+		State: "running",
+		Tags: map[string]string{
+			"ahs:instance-group": "web",
+			"ahs:instance-id":    "2",
+		},
+	})
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-1111", State: "running", Tags: map[string]string{"ahs:instance-group": "web"}})
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-9999", State: "running", Tags: map[string]string{"ahs:instance-group": "web"}})
+
+	c := &Clients{EC2: fake}
+
+	results := make(map[string]int, 2)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, instanceID := range []string{"i-1111", "i-9999"} {
+		wg.Add(1)
+		go func(instanceID string) {
+			defer wg.Done()
+			got, err := c.claimSequentialID(context.Background(), instanceID, "web", "ahs:instance-group", "ahs:instance-id", "", false, false)
+			if err != nil {
+				t.Errorf("unexpected error claiming for '%s': %s", instanceID, err)
+				return
+			}
+			mu.Lock()
+			results[instanceID] = got
+			mu.Unlock()
+		}(instanceID)
+	}
+	wg.Wait()
+
+	if results["i-1111"] == results["i-9999"] {
+		t.Fatalf("expected the two racing instances to land on distinct ids, got %v", results)
+	}
+	for instanceID, id := range results {
+		if id == 2 {
+			t.Fatalf("expected '%s' to skip id 2 already settled on 'i-aaaa', got %d", instanceID, id)
+		}
+	}
+}
+
+// TestClaimSequentialIDDryRunWritesNoTags guards against a --dry-run run
+// permanently claiming and promoting a real sequential id: dryRun must
+// report the first available candidate without writing or deleting any
+// claim or sequential-id tag on the instance.
+func TestClaimSequentialIDDryRunWritesNoTags(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-1111", State: "running", Tags: map[string]string{"ahs:instance-group": "web"}})
+
+	c := &Clients{EC2: fake}
+
+	got, err := c.claimSequentialID(context.Background(), "i-1111", "web", "ahs:instance-group", "ahs:instance-id", "", false, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != 1 {
+		t.Fatalf("expected candidate id 1, got %d", got)
+	}
+
+	if _, ok := fake.Instances["i-1111"].Tags["ahs:instance-id"]; ok {
+		t.Fatal("expected dry-run not to promote the sequential id tag")
+	}
+	if _, ok := fake.Instances["i-1111"].Tags[claimTagPrefix+"1"]; ok {
+		t.Fatal("expected dry-run not to write a claim tag")
+	}
+}
+
+// TestClaimSequentialIDToleratesDelayedTagVisibility guards against
+// resolveClaim treating a transient CreateTags visibility lag as a hard
+// failure: real EC2 tag writes aren't read-your-own-writes consistent, so a
+// lone, non-racing claimant can briefly see zero claimants right after
+// writing its own claim tag.
+func TestClaimSequentialIDToleratesDelayedTagVisibility(t *testing.T) {
+	fake := cloud.NewFakeEC2()
+	fake.AddInstance(&cloud.FakeInstance{ID: "i-1111", State: "running", Tags: map[string]string{"ahs:instance-group": "web"}})
+	fake.SetTagVisibilityDelay(30 * time.Millisecond)
+
+	c := &Clients{EC2: fake}
+
+	got, err := c.claimSequentialID(context.Background(), "i-1111", "web", "ahs:instance-group", "ahs:instance-id", "", false, false)
+	if err != nil {
+		t.Fatalf("expected claimSequentialID to retry through the visibility lag instead of erroring, got: %s", err)
+	}
+	if got != 1 {
+		t.Fatalf("expected 'i-1111' to claim id 1, got %d", got)
+	}
+}
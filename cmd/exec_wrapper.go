@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// ExecWrapper recovers from a panic anywhere within the wrapped action,
+// logging it and surfacing it as a regular cli.ExitError instead of
+// crashing the process outright.
+func ExecWrapper(f func(ctx *cli.Context) error) func(ctx *cli.Context) error {
+	return func(ctx *cli.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Recovered from a panic: %v", r)
+				err = cli.NewExitError(fmt.Sprintf("%v", r), 1)
+			}
+		}()
+
+		return f(ctx)
+	}
+}
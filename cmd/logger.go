@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Logger holds the configuration used to set up logrus.
+type Logger struct {
+	Level  string
+	Format string
+}
+
+// Configure sets the log level and format on the default logrus logger.
+func (l *Logger) Configure() error {
+	lvl, err := log.ParseLevel(l.Level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(lvl)
+
+	switch l.Format {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.SetFormatter(&log.TextFormatter{
+			FullTimestamp: true,
+		})
+	}
+
+	return nil
+}
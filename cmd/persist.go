@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/txn2/txeh"
+)
+
+const etcHostnamePath = "/etc/hostname"
+
+// hostnameFileMode is the conventional, world-readable mode /etc/hostname
+// carries; ioutil.TempFile creates its file 0600, so that has to be
+// restored explicitly before the rename or the persisted file ends up
+// unreadable by non-root users/processes.
+const hostnameFileMode = 0644
+
+// persistHostname atomically overwrites /etc/hostname with the new
+// hostname, via a tempfile + rename, so that a partial write can never
+// leave the file truncated or corrupt.
+func persistHostname(hostname string) error {
+	return writeHostnameFile(hostname, "/etc", etcHostnamePath)
+}
+
+// writeHostnameFile is persistHostname's testable core: it writes hostname
+// to a tempfile in tmpDir and renames it onto path.
+func writeHostnameFile(hostname, tmpDir, path string) error {
+	tmp, err := ioutil.TempFile(tmpDir, "hostname-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(hostname + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(hostnameFileMode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// persistHosts adds or replaces a "127.0.0.1 <hostname>" entry in
+// /etc/hosts.
+func persistHosts(hostname string) error {
+	return writeHostsEntry(hostname, "")
+}
+
+// writeHostsEntry is persistHosts's testable core: path overrides the hosts
+// file txeh reads from and writes to, defaulting to /etc/hosts when empty.
+func writeHostsEntry(hostname, path string) error {
+	var hosts *txeh.Hosts
+	var err error
+	if path == "" {
+		hosts, err = txeh.NewHostsDefault()
+	} else {
+		hosts, err = txeh.NewHosts(&txeh.HostsConfig{ReadFilePath: path, WriteFilePath: path})
+	}
+	if err != nil {
+		return err
+	}
+
+	hosts.RemoveHost(hostname)
+	hosts.AddHost("127.0.0.1", hostname)
+
+	return hosts.Save()
+}
+
+// rollbackHostsEntry removes newHostname's /etc/hosts entry and restores a
+// "127.0.0.1 <previous>" entry in its place.
+func rollbackHostsEntry(newHostname, previous string) error {
+	return revertHostsEntry(newHostname, previous, "")
+}
+
+// revertHostsEntry is rollbackHostsEntry's testable core: path overrides the
+// hosts file txeh reads from and writes to, defaulting to /etc/hosts when
+// empty.
+func revertHostsEntry(newHostname, previous, path string) error {
+	var hosts *txeh.Hosts
+	var err error
+	if path == "" {
+		hosts, err = txeh.NewHostsDefault()
+	} else {
+		hosts, err = txeh.NewHosts(&txeh.HostsConfig{ReadFilePath: path, WriteFilePath: path})
+	}
+	if err != nil {
+		return err
+	}
+
+	hosts.RemoveHost(newHostname)
+	hosts.AddHost("127.0.0.1", previous)
+
+	return hosts.Save()
+}
+
+// rollbackHostname best-effort restores the instance's local hostname, used
+// when a persist step or a later tag write fails partway through.
+// hostnamePersisted/hostsPersisted
+// report which of /etc/hostname and /etc/hosts had already been written by
+// the time the failure happened, since those are just as much "the
+// hostname" as the in-memory value and reverting only the latter would
+// leave the new hostname surviving the next reboot.
+func rollbackHostname(newHostname, previous string, hostnamePersisted, hostsPersisted bool) {
+	if previous == "" {
+		return
+	}
+
+	log.Warnf("Rolling back local hostname to '%s' after a persist or tag step failed", previous)
+	if err := setSystemHostname(previous); err != nil {
+		log.Errorf("Failed to roll back hostname to '%s': %s", previous, err)
+	}
+
+	if hostnamePersisted {
+		log.Warnf("Rolling back /etc/hostname to '%s'", previous)
+		if err := persistHostname(previous); err != nil {
+			log.Errorf("Failed to roll back /etc/hostname to '%s': %s", previous, err)
+		}
+	}
+
+	if hostsPersisted {
+		log.Warnf("Rolling back /etc/hosts entry to '%s'", previous)
+		if err := rollbackHostsEntry(newHostname, previous); err != nil {
+			log.Errorf("Failed to roll back /etc/hosts entry to '%s': %s", previous, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteHostnameFileUsesConventionalMode(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "hostname")
+
+	if err := writeHostnameFile("web-1", dir, target); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("unexpected error reading target: %s", err)
+	}
+	if string(got) != "web-1\n" {
+		t.Fatalf("expected content 'web-1\\n', got '%s'", got)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatalf("unexpected error statting target: %s", err)
+	}
+	if mode := info.Mode().Perm(); mode != hostnameFileMode {
+		t.Fatalf("expected mode %o, got %o", hostnameFileMode, mode)
+	}
+}
+
+func TestWriteHostsEntryAddsAndReplacesEntry(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+
+	if err := os.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatalf("unexpected error seeding hosts file: %s", err)
+	}
+
+	if err := writeHostsEntry("web-1", path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading hosts file: %s", err)
+	}
+	if !strings.Contains(string(got), "web-1") {
+		t.Fatalf("expected hosts file to contain 'web-1', got:\n%s", got)
+	}
+
+	// Re-persisting the same hostname must not duplicate the entry this
+	// call previously wrote.
+	if err := writeHostsEntry("web-1", path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading hosts file: %s", err)
+	}
+	if n := strings.Count(string(got), "web-1"); n != 1 {
+		t.Fatalf("expected exactly one 'web-1' entry after re-persisting, got %d in:\n%s", n, got)
+	}
+}
+
+func TestRevertHostsEntryRestoresPreviousHostname(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hosts")
+
+	if err := os.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644); err != nil {
+		t.Fatalf("unexpected error seeding hosts file: %s", err)
+	}
+
+	if err := writeHostsEntry("web-2", path); err != nil {
+		t.Fatalf("unexpected error persisting new hostname: %s", err)
+	}
+
+	if err := revertHostsEntry("web-2", "web-1", path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading hosts file: %s", err)
+	}
+	if strings.Contains(string(got), "web-2") {
+		t.Fatalf("expected rolled-back hostname 'web-2' to be removed, got:\n%s", got)
+	}
+	if !strings.Contains(string(got), "web-1") {
+		t.Fatalf("expected previous hostname 'web-1' to be restored, got:\n%s", got)
+	}
+}
@@ -0,0 +1,394 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// FakeInstance is an in-memory stand-in for an EC2 instance.
+type FakeInstance struct {
+	ID       string
+	State    string
+	AZ       string
+	Tags     map[string]string
+	HopLimit int32
+}
+
+// FakeEC2 is an in-memory implementation of EC2API, backed by a map of
+// FakeInstance keyed by instance-id. It is safe for concurrent use, which
+// makes it suitable for exercising race conditions between instances
+// claiming resources at the same time.
+type FakeEC2 struct {
+	mu                 sync.Mutex
+	Instances          map[string]*FakeInstance
+	tagVisibilityDelay time.Duration
+	tagWrittenAt       map[string]map[string]time.Time
+}
+
+// NewFakeEC2 returns an empty FakeEC2.
+func NewFakeEC2() *FakeEC2 {
+	return &FakeEC2{
+		Instances:    map[string]*FakeInstance{},
+		tagWrittenAt: map[string]map[string]time.Time{},
+	}
+}
+
+// SetTagVisibilityDelay makes tags written via CreateTags invisible to
+// DescribeInstances/DescribeTags for the given duration after the write,
+// simulating the real EC2 API's lack of read-your-own-writes consistency
+// between CreateTags and the Describe* calls, so callers that assume
+// immediate visibility can be caught by tests.
+func (f *FakeEC2) SetTagVisibilityDelay(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tagVisibilityDelay = d
+}
+
+// visibleTags returns i's tags, minus any still within tagVisibilityDelay of
+// their last CreateTags write.
+func (f *FakeEC2) visibleTags(i *FakeInstance) map[string]string {
+	if f.tagVisibilityDelay == 0 {
+		return i.Tags
+	}
+
+	now := time.Now()
+	visible := make(map[string]string, len(i.Tags))
+	for key, value := range i.Tags {
+		if writtenAt, tracked := f.tagWrittenAt[i.ID][key]; tracked && now.Sub(writtenAt) < f.tagVisibilityDelay {
+			continue
+		}
+		visible[key] = value
+	}
+
+	return visible
+}
+
+// AddInstance registers a FakeInstance, overwriting any existing instance
+// with the same ID.
+func (f *FakeEC2) AddInstance(i *FakeInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if i.Tags == nil {
+		i.Tags = map[string]string{}
+	}
+	f.Instances[i.ID] = i
+}
+
+// DescribeInstances implements EC2API.
+func (f *FakeEC2) DescribeInstances(_ context.Context, input *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ids := map[string]bool{}
+	for _, id := range input.InstanceIds {
+		ids[id] = true
+	}
+
+	var instances []types.Instance
+	for _, i := range f.sortedInstances() {
+		if len(ids) > 0 && !ids[i.ID] {
+			continue
+		}
+
+		view := *i
+		view.Tags = f.visibleTags(i)
+
+		if !matchesFilters(&view, input.Filters) {
+			continue
+		}
+
+		instances = append(instances, view.toEC2Instance())
+	}
+
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []types.Reservation{
+			{Instances: instances},
+		},
+	}, nil
+}
+
+// DescribeTags implements EC2API.
+func (f *FakeEC2) DescribeTags(_ context.Context, input *ec2.DescribeTagsInput, _ ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := validateDescribeTagsFilters(input.Filters); err != nil {
+		return nil, err
+	}
+
+	var tags []types.TagDescription
+	for _, i := range f.sortedInstances() {
+		view := *i
+		view.Tags = f.visibleTags(i)
+
+		if !matchesFilters(&view, input.Filters) {
+			continue
+		}
+
+		for _, key := range sortedKeys(view.Tags) {
+			value := view.Tags[key]
+			if !matchesTagFilters(key, value, input.Filters) {
+				continue
+			}
+
+			tags = append(tags, types.TagDescription{
+				ResourceId:   aws.String(i.ID),
+				ResourceType: types.ResourceTypeInstance,
+				Key:          aws.String(key),
+				Value:        aws.String(value),
+			})
+		}
+	}
+
+	return &ec2.DescribeTagsOutput{Tags: tags}, nil
+}
+
+// CreateTags implements EC2API.
+func (f *FakeEC2) CreateTags(_ context.Context, input *ec2.CreateTagsInput, _ ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, resource := range input.Resources {
+		i, ok := f.Instances[resource]
+		if !ok {
+			return nil, fmt.Errorf("InvalidInstanceID.NotFound: instance '%s' does not exist", resource)
+		}
+
+		for _, tag := range input.Tags {
+			i.Tags[*tag.Key] = *tag.Value
+
+			if f.tagVisibilityDelay > 0 {
+				if f.tagWrittenAt[i.ID] == nil {
+					f.tagWrittenAt[i.ID] = map[string]time.Time{}
+				}
+				f.tagWrittenAt[i.ID][*tag.Key] = time.Now()
+			}
+		}
+	}
+
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// DeleteTags implements the subset of the DeleteTags API used to roll back
+// a failed optimistic claim.
+func (f *FakeEC2) DeleteTags(_ context.Context, input *ec2.DeleteTagsInput, _ ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, resource := range input.Resources {
+		i, ok := f.Instances[resource]
+		if !ok {
+			continue
+		}
+
+		for _, tag := range input.Tags {
+			delete(i.Tags, *tag.Key)
+		}
+	}
+
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// ModifyInstanceMetadataOptions implements EC2API.
+func (f *FakeEC2) ModifyInstanceMetadataOptions(_ context.Context, input *ec2.ModifyInstanceMetadataOptionsInput, _ ...func(*ec2.Options)) (*ec2.ModifyInstanceMetadataOptionsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i, ok := f.Instances[*input.InstanceId]
+	if !ok {
+		return nil, fmt.Errorf("InvalidInstanceID.NotFound: instance '%s' does not exist", *input.InstanceId)
+	}
+
+	if input.HttpPutResponseHopLimit != nil {
+		i.HopLimit = *input.HttpPutResponseHopLimit
+	}
+
+	return &ec2.ModifyInstanceMetadataOptionsOutput{InstanceId: aws.String(i.ID)}, nil
+}
+
+func (f *FakeEC2) sortedInstances() []*FakeInstance {
+	var instances []*FakeInstance
+	for _, i := range f.Instances {
+		instances = append(instances, i)
+	}
+
+	sort.Slice(instances, func(a, b int) bool {
+		return instances[a].ID < instances[b].ID
+	})
+
+	return instances
+}
+
+func (i *FakeInstance) toEC2Instance() types.Instance {
+	var tags []types.Tag
+	for _, key := range sortedKeys(i.Tags) {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(i.Tags[key])})
+	}
+
+	return types.Instance{
+		InstanceId: aws.String(i.ID),
+		State:      &types.InstanceState{Name: types.InstanceStateName(i.State)},
+		Placement:  &types.Placement{AvailabilityZone: aws.String(i.AZ)},
+		Tags:       tags,
+	}
+}
+
+// validateDescribeTagsFilters rejects filter names that the real
+// DescribeTags API doesn't support (e.g. placement-availability-zone,
+// instance-state-name, which are DescribeInstances-only), so a caller that
+// mixes up the two APIs fails against the fake exactly as it would against
+// real AWS instead of silently getting a permissive match.
+func validateDescribeTagsFilters(filters []types.Filter) error {
+	for _, filter := range filters {
+		switch name := *filter.Name; {
+		case name == "resource-id", name == "resource-type", name == "key", name == "value", strings.HasPrefix(name, "tag:"):
+		default:
+			return fmt.Errorf("InvalidParameterValue: filter '%s' is not supported by DescribeTags", name)
+		}
+	}
+
+	return nil
+}
+
+// matchesFilters evaluates the instance-level filters supported by the real
+// EC2 API that ahs relies on: instance-state-name, instance-id,
+// resource-id, resource-type, placement-availability-zone, tag-key and
+// tag:<key>.
+func matchesFilters(i *FakeInstance, filters []types.Filter) bool {
+	for _, filter := range filters {
+		name := *filter.Name
+
+		switch {
+		case name == "instance-state-name":
+			if !containsValue(filter.Values, i.State) {
+				return false
+			}
+		case name == "instance-id" || name == "resource-id":
+			if !containsValue(filter.Values, i.ID) {
+				return false
+			}
+		case name == "resource-type":
+			if !containsValue(filter.Values, "instance") {
+				return false
+			}
+		case name == "placement-availability-zone":
+			if !containsValue(filter.Values, i.AZ) {
+				return false
+			}
+		case name == "tag-key":
+			found := false
+			for _, v := range filter.Values {
+				if _, ok := i.Tags[v]; ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			key := strings.TrimPrefix(name, "tag:")
+			value, ok := i.Tags[key]
+			if !ok || !containsValue(filter.Values, value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// matchesTagFilters evaluates the tag-level filters (key, value) used by
+// DescribeTags, applied once per (key, value) pair of a given instance.
+func matchesTagFilters(key, value string, filters []types.Filter) bool {
+	for _, filter := range filters {
+		switch *filter.Name {
+		case "key":
+			if !containsValue(filter.Values, key) {
+				return false
+			}
+		case "value":
+			if !containsValue(filter.Values, value) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func containsValue(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// FakeMetadata is an in-memory implementation of MetadataAPI.
+type FakeMetadata struct {
+	mu        sync.Mutex
+	available bool
+	data      map[string]string
+}
+
+// NewFakeMetadata returns a FakeMetadata seeded with the given metadata
+// path/value pairs (e.g. "instance-id", "placement/availability-zone").
+func NewFakeMetadata(data map[string]string) *FakeMetadata {
+	return &FakeMetadata{
+		available: true,
+		data:      data,
+	}
+}
+
+// GetMetadata implements MetadataAPI.
+func (f *FakeMetadata) GetMetadata(_ context.Context, params *imds.GetMetadataInput, _ ...func(*imds.Options)) (*imds.GetMetadataOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.available {
+		return nil, fmt.Errorf("EC2MetadataRequestError: metadata service is not reachable")
+	}
+
+	value, ok := f.data[params.Path]
+	if !ok {
+		return nil, fmt.Errorf("EC2MetadataError: no value seeded for path '%s'", params.Path)
+	}
+
+	return &imds.GetMetadataOutput{
+		Content: io.NopCloser(strings.NewReader(value)),
+	}, nil
+}
+
+// SetAvailable toggles whether the metadata service responds, to exercise
+// the "not running on EC2" error path.
+func (f *FakeMetadata) SetAvailable(available bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.available = available
+}
@@ -0,0 +1,70 @@
+package cloud
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// TestDescribeTagsRejectsUnsupportedFilter guards against the fake silently
+// matching filters the real DescribeTags API doesn't support (e.g.
+// placement-availability-zone, which is DescribeInstances-only), which
+// would otherwise mask callers that mix up the two APIs.
+func TestDescribeTagsRejectsUnsupportedFilter(t *testing.T) {
+	f := NewFakeEC2()
+	f.AddInstance(&FakeInstance{ID: "i-1", State: "running", AZ: "eu-west-1a"})
+
+	_, err := f.DescribeTags(context.Background(), &ec2.DescribeTagsInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("placement-availability-zone"),
+				Values: []string{"eu-west-1a"},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected an error for a placement-availability-zone filter, DescribeTags doesn't support it")
+	}
+}
+
+// TestSetTagVisibilityDelayHidesRecentWrites guards the fake mode used to
+// exercise callers that assume CreateTags is read-your-own-writes
+// consistent against DescribeInstances/DescribeTags, which real EC2 is not.
+func TestSetTagVisibilityDelayHidesRecentWrites(t *testing.T) {
+	f := NewFakeEC2()
+	f.AddInstance(&FakeInstance{ID: "i-1", State: "running"})
+	f.SetTagVisibilityDelay(50 * time.Millisecond)
+
+	if _, err := f.CreateTags(context.Background(), &ec2.CreateTagsInput{
+		Resources: []string{"i-1"},
+		Tags:      []types.Tag{{Key: aws.String("ahs:claim-1"), Value: aws.String("i-1")}},
+	}); err != nil {
+		t.Fatalf("unexpected error creating tag: %s", err)
+	}
+
+	out, err := f.DescribeTags(context.Background(), &ec2.DescribeTagsInput{
+		Filters: []types.Filter{{Name: aws.String("resource-id"), Values: []string{"i-1"}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(out.Tags) != 0 {
+		t.Fatalf("expected the just-written tag to still be hidden, got %v", out.Tags)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	out, err = f.DescribeTags(context.Background(), &ec2.DescribeTagsInput{
+		Filters: []types.Filter{{Name: aws.String("resource-id"), Values: []string{"i-1"}}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(out.Tags) != 1 {
+		t.Fatalf("expected the tag to become visible after the delay, got %v", out.Tags)
+	}
+}
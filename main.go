@@ -0,0 +1,13 @@
+// Package main is a thin entrypoint over cli: the urfave/cli commands' Action
+// funcs live in cmd rather than here because Go cannot import a main
+// package, so any logic they invoke has to sit in its own importable
+// package.
+package main
+
+import "github.com/mvisonneau/ahs/cli"
+
+var version = "development"
+
+func main() {
+	cli.Run(version)
+}